@@ -0,0 +1,30 @@
+// Command tree-cache-rebuild seeds an Uploader's persistent tree-existence
+// cache (see uploader.RebuildTreeCache) from an existing ClickHouse
+// deployment's graphite_tree table, for installations upgrading to a
+// persistent tree cache that don't want carbon-clickhouse to re-emit every
+// path it already knows.
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/lomik/carbon-clickhouse/uploader"
+)
+
+func main() {
+	chURL := flag.String("clickhouse-url", "http://localhost:8123", "ClickHouse HTTP URL")
+	treeTable := flag.String("tree-table", "graphite_tree", "ClickHouse tree table")
+	out := flag.String("out", "tree-cache.bin", "output tree-cache file path")
+	mode := flag.String("mode", uploader.TreeCacheModeExact, "tree cache mode: exact or bloom")
+	timeout := flag.Duration("timeout", time.Minute, "ClickHouse query timeout")
+	flag.Parse()
+
+	if err := uploader.RebuildTreeCache(*chURL, *treeTable, *out, *mode, *timeout); err != nil {
+		logrus.Fatalf("[tree-cache-rebuild] %s", err.Error())
+		os.Exit(1)
+	}
+}
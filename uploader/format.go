@@ -0,0 +1,340 @@
+package uploader
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Data table wire formats accepted by DataFormat. Only TabSeparated is
+// understood by the tree-index splitter below; files uploaded with any
+// other format skip tree indexing (see uploadFile).
+const (
+	DataFormatTabSeparated = "TabSeparated"
+	DataFormatRowBinary    = "RowBinary"
+	DataFormatNative       = "Native"
+)
+
+// DataFormat sets the ClickHouse FORMAT used for the data table INSERT.
+// The on-disk files must already be encoded in this format; carbon-clickhouse
+// posts them as-is. Defaults to "TabSeparated".
+func DataFormat(format string) Option {
+	return func(u *Uploader) {
+		u.dataFormat = format
+	}
+}
+
+// Compression sets the Content-Encoding used for uploads. Only "gzip" is
+// supported; the empty string (default) disables compression.
+func Compression(c string) Option {
+	return func(u *Uploader) {
+		u.compression = c
+	}
+}
+
+// uploadData POSTs data to table using the given wire format, streaming it
+// through a gzip.Writer on a pipe when compression is "gzip". It returns the
+// number of bytes actually written to the wire (the compressed size, when
+// compression is enabled).
+func uploadData(ctx context.Context, chUrl string, table string, format string, compression string, timeout time.Duration, data io.Reader) (int64, error) {
+	p, err := url.Parse(chUrl)
+	if err != nil {
+		return 0, err
+	}
+
+	q := p.Query()
+	q.Set("query", fmt.Sprintf("INSERT INTO %s FORMAT %s", table, format))
+
+	body := data
+	if compression == "gzip" {
+		q.Set("enable_http_compression", "1")
+		body = gzipStream(data)
+	}
+	p.RawQuery = q.Encode()
+
+	cr := &countingReader{r: body}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.String(), cr)
+	if err != nil {
+		return 0, err
+	}
+	if compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return cr.n, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode != 200 {
+		return cr.n, fmt.Errorf("clickhouse response status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	return cr.n, nil
+}
+
+// countingReader wraps r, counting the bytes actually read off it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Close forwards to r when r is itself closable (e.g. an *os.File), so
+// countingReader can stand in for r in an http.Request body.
+func (c *countingReader) Close() error {
+	if rc, ok := c.r.(io.Closer); ok {
+		return rc.Close()
+	}
+	return nil
+}
+
+// gzipStream returns a reader yielding the gzip-compressed form of r,
+// compressed on the fly by a goroutine writing into an io.Pipe. If r is
+// itself closable, it is closed once fully read.
+func gzipStream(r io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+
+	go func() {
+		gw := gzip.NewWriter(pw)
+		_, err := io.Copy(gw, r)
+		if closeErr := gw.Close(); err == nil {
+			err = closeErr
+		}
+		if rc, ok := r.(io.Closer); ok {
+			if closeErr := rc.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+// pacedUploadData runs uploadData through u.pacer, if one is configured.
+// newReader is called once per attempt rather than taking a plain io.Reader,
+// since a throttled response makes pacer.Call retry the whole POST and the
+// body must be re-read from the start each time.
+func (u *Uploader) pacedUploadData(ctx context.Context, table string, format string, timeout time.Duration, newReader func() (io.Reader, error)) (int64, error) {
+	if u.pacer == nil {
+		r, err := newReader()
+		if err != nil {
+			return 0, err
+		}
+		return uploadData(ctx, u.clickHouseDSN, table, format, u.compression, timeout, r)
+	}
+
+	var n int64
+	err := u.pacer.Call(ctx, func() error {
+		r, err := newReader()
+		if err != nil {
+			return err
+		}
+
+		var uploadErr error
+		n, uploadErr = uploadData(ctx, u.clickHouseDSN, table, format, u.compression, timeout, r)
+		return uploadErr
+	})
+	return n, err
+}
+
+// fileReaderFactory returns a newReader func (see pacedUploadData) that
+// reopens filename from the start on every call.
+func fileReaderFactory(filename string) func() (io.Reader, error) {
+	return func() (io.Reader, error) {
+		return os.Open(filename)
+	}
+}
+
+// pacedUploadDataOnce runs uploadData through u.pacer's CallOnce instead of
+// Call, for data (a tee'd pipe) that can only be read once and so can't be
+// replayed if pacedUploadData retried it on a throttled response.
+func (u *Uploader) pacedUploadDataOnce(ctx context.Context, table string, format string, timeout time.Duration, data io.Reader) (int64, error) {
+	if u.pacer == nil {
+		return uploadData(ctx, u.clickHouseDSN, table, format, u.compression, timeout, data)
+	}
+
+	var n int64
+	err := u.pacer.CallOnce(ctx, func() error {
+		var uploadErr error
+		n, uploadErr = uploadData(ctx, u.clickHouseDSN, table, format, u.compression, timeout, data)
+		return uploadErr
+	})
+	return n, err
+}
+
+// uploadFile streams filename to the data table exactly once. If the tree
+// table is configured and the on-disk format is TabSeparated, the same
+// bytes are teed into the tree-index splitter as they are read, instead of
+// reopening the file to build the index as a second pass.
+func (u *Uploader) uploadFile(ctx context.Context, filename string, r io.Reader) error {
+	if u.treeTable == "" || u.dataFormat != DataFormatTabSeparated {
+		dataStart := time.Now()
+		n, err := u.pacedUploadData(ctx, u.dataTable, u.dataFormat, u.dataTimeout, fileReaderFactory(filename))
+		atomic.StoreInt64(&u.stats.lastDataUpload, int64(time.Now().Sub(dataStart)))
+		if err != nil {
+			return err
+		}
+
+		atomic.AddUint64(&u.stats.dataBytesUploaded, uint64(n))
+
+		if u.treeTable != "" {
+			logrus.Warnf("[uploader] %s: tree index skipped, DataFormat %q is not splittable", filename, u.dataFormat)
+		}
+		return nil
+	}
+
+	return u.uploadFileWithTree(ctx, filename, r)
+}
+
+// uploadFileWithTree does the single-read tee described by uploadFile's
+// doc comment. The data table upload runs in a goroutine reading off an
+// io.Pipe while the caller's goroutine reads the same raw bytes through the
+// tee to build the tree-index buffer. Both sides must finish before the
+// tree table is uploaded, and an error on either side cancels the other.
+func (u *Uploader) uploadFileWithTree(ctx context.Context, filename string, r io.Reader) error {
+	pr, pw := io.Pipe()
+
+	dataErrCh := make(chan error, 1)
+	var dataBytes int64
+	go func() {
+		dataStart := time.Now()
+		n, err := u.pacedUploadDataOnce(ctx, u.dataTable, u.dataFormat, u.dataTimeout, pr)
+		atomic.StoreInt64(&u.stats.lastDataUpload, int64(time.Now().Sub(dataStart)))
+		dataBytes = n
+		pr.CloseWithError(err)
+		dataErrCh <- err
+	}()
+
+	treeData := bytes.NewBuffer(nil)
+	newKeys, treeErr := u.buildTree(io.TeeReader(r, pw), treeData)
+
+	if treeErr != nil {
+		pw.CloseWithError(treeErr)
+	} else if err := pw.Close(); err != nil {
+		treeErr = err
+	}
+
+	dataErr := <-dataErrCh
+
+	if treeErr != nil {
+		return treeErr
+	}
+	if dataErr != nil {
+		return dataErr
+	}
+
+	atomic.AddUint64(&u.stats.dataBytesUploaded, uint64(dataBytes))
+
+	treeBytes := treeData.Bytes()
+	treeStart := time.Now()
+	_, err := u.pacedUploadData(ctx, u.treeTable, DataFormatTabSeparated, u.treeTimeout, func() (io.Reader, error) {
+		return bytes.NewReader(treeBytes), nil
+	})
+	atomic.StoreInt64(&u.stats.lastTreeUpload, int64(time.Now().Sub(treeStart)))
+	if err != nil {
+		return err
+	}
+
+	// Only record these keys as known once the tree table actually has
+	// them -- adding them before the upload is confirmed would make a
+	// retry after a failed POST see them as already-existing and skip
+	// re-emitting their rows, losing them for good.
+	for key := range newKeys {
+		u.treeExists.Add(key)
+	}
+
+	return nil
+}
+
+// buildTree splits TabSeparated rows read from r into the tree-index rows
+// written to treeData, and returns the set of keys newly seen in this file
+// (not yet in u.treeExists) for the caller to record once the resulting
+// treeData has actually been uploaded.
+func (u *Uploader) buildTree(r io.Reader, treeData *bytes.Buffer) (map[string]bool, error) {
+	reader := bufio.NewReaderSize(r, 1024*1024)
+
+	localUniq := make(map[string]bool)
+
+	var key string
+	var level int
+	var exists bool
+	var date string
+
+LineLoop:
+	for {
+		line, _, err := reader.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		row := strings.Split(string(line), "\t")
+		metric := row[0]
+
+		if u.treeExists.Exists(metric) {
+			atomic.AddUint64(&u.stats.treeCacheHits, 1)
+			continue LineLoop
+		}
+
+		if _, exists = localUniq[metric]; exists {
+			continue LineLoop
+		}
+
+		date = row[3][:8] + "01" // first day of month
+
+		offset := 0
+		for level = 1; ; level++ {
+			p := strings.IndexByte(metric[offset:], '.')
+			if p < 0 {
+				break
+			}
+			key = metric[:offset+p+1]
+
+			if !u.treeExists.Exists(key) {
+				if _, exists := localUniq[key]; !exists {
+					localUniq[key] = true
+					fmt.Fprintf(treeData, "%s\t%d\t%s\n", date, level, key)
+					atomic.AddUint64(&u.stats.treeCacheMisses, 1)
+					atomic.AddUint64(&u.stats.treeRowsWritten, 1)
+				}
+			} else {
+				atomic.AddUint64(&u.stats.treeCacheHits, 1)
+			}
+
+			offset += p + 1
+		}
+
+		localUniq[metric] = true
+		fmt.Fprintf(treeData, "%s\t%d\t%s\n", date, level, metric)
+		atomic.AddUint64(&u.stats.treeCacheMisses, 1)
+		atomic.AddUint64(&u.stats.treeRowsWritten, 1)
+	}
+
+	return localUniq, nil
+}
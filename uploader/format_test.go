@@ -0,0 +1,181 @@
+package uploader
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestUploadFileWithTreeDataThrottleSurfacesCleanly reproduces a ClickHouse
+// throttle response on the tee'd data-table leg with a Pacer configured.
+// Since the pipe feeding it can only be read once, pacedUploadDataOnce must
+// not ask the pacer to retry it in place -- it should surface the real
+// throttle error once, so the caller's own per-file retry (in retry.go)
+// re-uploads the whole file later, instead of the pacer masking it behind a
+// confusing "already consumed" error after a single silent attempt.
+func TestUploadFileWithTreeDataThrottleSurfacesCleanly(t *testing.T) {
+	var calls int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "clickhouse response status 429: Too many simultaneous queries", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	u := New(
+		ClickHouse(server.URL),
+		DataTable("graphite"),
+		DataTimeout(2*time.Second),
+		TreeTable("graphite_tree"),
+		TreeTimeout(2*time.Second),
+		Pacer(time.Millisecond, 10*time.Millisecond, 0.5),
+	)
+
+	r := &slowLineReader{lines: [][]byte{[]byte("a.b.c\t1\t2\t20230101000000\n")}}
+
+	err := u.uploadFileWithTree(context.Background(), "test-file", r)
+	if err == nil {
+		t.Fatal("uploadFileWithTree returned nil, want the throttle error to surface")
+	}
+	if got := err.Error(); !strings.Contains(got, "429") {
+		t.Fatalf("uploadFileWithTree returned %v, want the real throttle response, not a replay error", got)
+	}
+	if calls != 1 {
+		t.Fatalf("data table handler called %d times, want 1 (the pacer must not retry an already-consumed pipe)", calls)
+	}
+}
+
+// errAfterReader yields data once, then fails every subsequent Read with
+// err -- used to force buildTree to fail partway through a file.
+type errAfterReader struct {
+	data []byte
+	err  error
+	sent bool
+}
+
+func (r *errAfterReader) Read(p []byte) (int, error) {
+	if !r.sent {
+		r.sent = true
+		return copy(p, r.data), nil
+	}
+	return 0, r.err
+}
+
+func TestUploadFileWithTreeTreeErrorCancelsDataSide(t *testing.T) {
+	var bodyReadErr atomic.Value // error, set from inside the handler
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.Copy(ioutil.Discard, r.Body)
+		if err != nil {
+			bodyReadErr.Store(err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	u := New(
+		ClickHouse(server.URL),
+		DataTable("graphite"),
+		DataTimeout(2*time.Second),
+		TreeTable("graphite_tree"),
+		TreeTimeout(2*time.Second),
+	)
+
+	wantErr := io.ErrUnexpectedEOF
+	r := &errAfterReader{data: []byte("a.b.c\t1\t2\t20230101000000\n"), err: wantErr}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- u.uploadFileWithTree(context.Background(), "test-file", r)
+	}()
+
+	select {
+	case err := <-done:
+		if err != wantErr {
+			t.Fatalf("uploadFileWithTree returned %v, want %v", err, wantErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("uploadFileWithTree did not return after the tree side errored -- the data side did not get cancelled")
+	}
+
+	// The server-side Read that observes the abandoned body can lag the
+	// client-side return by a moment; poll briefly instead of racing it.
+	deadline := time.Now().Add(2 * time.Second)
+	for bodyReadErr.Load() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if bodyReadErr.Load() == nil {
+		t.Errorf("data table handler read the whole request body cleanly; want the pipe aborted with the tree-side error instead")
+	}
+}
+
+func TestUploadFileWithTreeDataErrorCancelsTreeSide(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "clickhouse response status 500: boom", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	u := New(
+		ClickHouse(server.URL),
+		DataTable("graphite"),
+		DataTimeout(2*time.Second),
+		TreeTable("graphite_tree"),
+		TreeTimeout(2*time.Second),
+	)
+
+	// A slow source: if the data-side failure didn't cancel the tee, this
+	// would block far past the 5s test deadline below.
+	r := &slowLineReader{
+		lines: func() [][]byte {
+			lines := make([][]byte, 50)
+			for i := range lines {
+				lines[i] = []byte("a.b.c\t1\t2\t20230101000000\n")
+			}
+			return lines
+		}(),
+		delay: 200 * time.Millisecond,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- u.uploadFileWithTree(context.Background(), "test-file", r)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("uploadFileWithTree returned nil error, want the data-table failure (or the tee error it causes) to surface")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("uploadFileWithTree did not return after the data side errored -- the tree side did not get cancelled")
+	}
+}
+
+// slowLineReader hands back one pre-built line per Read call, sleeping
+// delay between calls after the first -- enough to let a concurrent
+// failure on the other side of the tee interrupt it before it runs to
+// completion.
+type slowLineReader struct {
+	lines [][]byte
+	delay time.Duration
+	idx   int
+}
+
+func (r *slowLineReader) Read(p []byte) (int, error) {
+	if r.idx >= len(r.lines) {
+		return 0, io.EOF
+	}
+	if r.idx > 0 {
+		time.Sleep(r.delay)
+	}
+	n := copy(p, r.lines[r.idx])
+	r.idx++
+	return n, nil
+}
@@ -0,0 +1,112 @@
+package uploader
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPacerRetries bounds how many times pacer.Call will retry a throttled
+// call before giving up and returning the last error to the caller.
+const maxPacerRetries = 5
+
+// pacer throttles ClickHouse insert calls with an exponential-decay sleep:
+// a successful call decays the sleep toward min, a throttling response
+// doubles it toward max.
+type pacer struct {
+	sync.Mutex
+	min   time.Duration
+	max   time.Duration
+	decay float64
+	sleep time.Duration
+}
+
+func newPacer(min, max time.Duration, decay float64) *pacer {
+	return &pacer{min: min, max: max, decay: decay, sleep: min}
+}
+
+// step sleeps for the pacer's current delay, runs fn once, and adjusts the
+// delay based on the result: doubled toward max on a throttling error,
+// decayed toward min on success, left unchanged on a hard failure.
+func (p *pacer) step(ctx context.Context, fn func() error) (error, bool) {
+	p.Lock()
+	sleep := p.sleep
+	p.Unlock()
+
+	if sleep > 0 {
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return ctx.Err(), false
+		}
+	}
+
+	err := fn()
+
+	p.Lock()
+	throttled := isThrottled(err)
+	switch {
+	case throttled:
+		p.sleep *= 2
+		if p.sleep > p.max {
+			p.sleep = p.max
+		}
+	case err == nil:
+		p.sleep = time.Duration(float64(p.sleep) * p.decay)
+		if p.sleep < p.min {
+			p.sleep = p.min
+		}
+	}
+	p.Unlock()
+
+	return err, throttled
+}
+
+// Call runs fn, retrying in place up to maxPacerRetries times on a
+// throttling error. fn must be safe to call more than once.
+func (p *pacer) Call(ctx context.Context, fn func() error) error {
+	var err error
+	var throttled bool
+
+	for attempt := 0; attempt <= maxPacerRetries; attempt++ {
+		err, throttled = p.step(ctx, fn)
+		if !throttled {
+			return err
+		}
+	}
+
+	return err
+}
+
+// CallOnce runs fn exactly once, still subject to the pacer's sleep and
+// delay adjustment, for callers whose fn can't be safely retried (e.g. a
+// tee'd pipe that can only be read once). A throttling error is returned
+// as-is instead of retried here; the per-file backoff/quarantine layer in
+// retry.go picks the file up again later.
+func (p *pacer) CallOnce(ctx context.Context, fn func() error) error {
+	err, _ := p.step(ctx, fn)
+	return err
+}
+
+// isThrottled reports whether err looks like ClickHouse asking the client
+// to slow down, as opposed to a hard failure.
+func isThrottled(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := err.Error()
+	return strings.Contains(msg, "status 429") ||
+		strings.Contains(msg, "status 503") ||
+		strings.Contains(msg, "Too many simultaneous queries") ||
+		strings.Contains(msg, "Memory limit exceeded")
+}
+
+// Pacer gates every ClickHouse insert behind an adaptive rate limiter: decay
+// is the multiplier applied to the sleep after a successful call (e.g. 0.9).
+func Pacer(min, max time.Duration, decay float64) Option {
+	return func(u *Uploader) {
+		u.pacer = newPacer(min, max, decay)
+	}
+}
@@ -0,0 +1,89 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPacerThrottleThenSucceed(t *testing.T) {
+	p := newPacer(time.Millisecond, 10*time.Millisecond, 0.5)
+
+	attempts := 0
+	err := p.Call(context.Background(), func() error {
+		attempts++
+		if attempts < 3 {
+			return fmt.Errorf("clickhouse response status 429: Too many simultaneous queries")
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Call returned %v, want nil", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("fn called %d times, want 3", attempts)
+	}
+	// Decay is gradual (sleep *= decay), not an immediate snap to min: after
+	// two throttles sleep reached 4ms, so one success only brings it to 2ms.
+	if p.sleep >= 4*time.Millisecond || p.sleep < p.min {
+		t.Fatalf("sleep = %s after a successful call, want in [%s, %s)", p.sleep, p.min, 4*time.Millisecond)
+	}
+}
+
+func TestPacerGivesUpAfterMaxRetries(t *testing.T) {
+	p := newPacer(time.Millisecond, 10*time.Millisecond, 0.5)
+
+	attempts := 0
+	wantErr := fmt.Errorf("status 503: throttled forever")
+	err := p.Call(context.Background(), func() error {
+		attempts++
+		return wantErr
+	})
+
+	if err != wantErr {
+		t.Fatalf("Call returned %v, want %v", err, wantErr)
+	}
+	if attempts != maxPacerRetries+1 {
+		t.Fatalf("fn called %d times, want %d", attempts, maxPacerRetries+1)
+	}
+}
+
+func TestPacerCallOnceDoesNotRetryOnThrottle(t *testing.T) {
+	p := newPacer(time.Millisecond, 10*time.Millisecond, 0.5)
+
+	attempts := 0
+	wantErr := fmt.Errorf("clickhouse response status 429: Too many simultaneous queries")
+	err := p.CallOnce(context.Background(), func() error {
+		attempts++
+		return wantErr
+	})
+
+	if err != wantErr {
+		t.Fatalf("CallOnce returned %v, want %v", err, wantErr)
+	}
+	if attempts != 1 {
+		t.Fatalf("fn called %d times, want 1", attempts)
+	}
+	if p.sleep != 2*p.min {
+		t.Fatalf("sleep = %s after a throttled call, want %s (doubled from min)", p.sleep, 2*p.min)
+	}
+}
+
+func TestPacerDoesNotDecayOnHardFailure(t *testing.T) {
+	p := newPacer(time.Millisecond, 10*time.Millisecond, 0.5)
+	p.sleep = 8 * time.Millisecond
+
+	wantErr := fmt.Errorf("clickhouse response status 500: syntax error")
+	err := p.Call(context.Background(), func() error {
+		return wantErr
+	})
+
+	if err != wantErr {
+		t.Fatalf("Call returned %v, want %v", err, wantErr)
+	}
+	if p.sleep != 8*time.Millisecond {
+		t.Fatalf("sleep = %s after a hard failure, want unchanged 8ms", p.sleep)
+	}
+}
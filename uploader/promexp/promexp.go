@@ -0,0 +1,136 @@
+// Package promexp exposes uploader.Stats as Prometheus metrics.
+package promexp
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/lomik/carbon-clickhouse/uploader"
+)
+
+const namespace = "carbon_clickhouse"
+const subsystem = "uploader"
+
+// Exporter turns uploader.Stats snapshots into Prometheus metrics. Pass
+// Exporter.Update as an uploader.StatsCallback and mount Exporter.Handler()
+// on an http.ServeMux to serve them.
+type Exporter struct {
+	sync.Mutex
+	reg *prometheus.Registry
+
+	filesUploaded     prometheus.Counter
+	filesFailed       prometheus.Counter
+	dataBytesUploaded prometheus.Counter
+	treeRowsWritten   prometheus.Counter
+	treeCacheHits     prometheus.Counter
+	treeCacheMisses   prometheus.Counter
+	queueDepth        prometheus.Gauge
+	inFlight          prometheus.Gauge
+	lastDataUpload    prometheus.Gauge
+	lastTreeUpload    prometheus.Gauge
+
+	last uploader.Stats
+}
+
+func counter(name, help string) prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      help,
+	})
+}
+
+func gauge(name, help string) prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      help,
+	})
+}
+
+// New creates an Exporter with its own registry, independent of the
+// default Prometheus registry.
+func New() *Exporter {
+	e := &Exporter{
+		reg:               prometheus.NewRegistry(),
+		filesUploaded:     counter("files_uploaded_total", "Total files successfully uploaded"),
+		filesFailed:       counter("files_failed_total", "Total failed upload attempts, including retries"),
+		dataBytesUploaded: counter("data_bytes_uploaded_total", "Total bytes POSTed to the data table"),
+		treeRowsWritten:   counter("tree_rows_written_total", "Total rows POSTed to the tree table"),
+		treeCacheHits:     counter("tree_cache_hits_total", "Metrics/paths already known, skipped"),
+		treeCacheMisses:   counter("tree_cache_misses_total", "Metrics/paths newly inserted into the tree table"),
+		queueDepth:        gauge("queue_depth", "Files currently waiting in the upload queue"),
+		inFlight:          gauge("in_flight", "Uploads currently in progress"),
+		lastDataUpload:    gauge("last_data_upload_seconds", "Duration of the most recent data table upload"),
+		lastTreeUpload:    gauge("last_tree_upload_seconds", "Duration of the most recent tree table upload"),
+	}
+
+	e.reg.MustRegister(
+		e.filesUploaded,
+		e.filesFailed,
+		e.dataBytesUploaded,
+		e.treeRowsWritten,
+		e.treeCacheHits,
+		e.treeCacheMisses,
+		e.queueDepth,
+		e.inFlight,
+		e.lastDataUpload,
+		e.lastTreeUpload,
+	)
+
+	return e
+}
+
+// Update pushes a fresh Stats snapshot into the registered metrics. It has
+// the signature of an uploader.StatsCallback:
+//
+//	u := uploader.New(uploader.StatsCallback(exporter.Update), ...)
+//
+// With Threads>1, uploader calls StatsCallback from every upload worker
+// goroutine, so snapshots can arrive interleaved or out of order. Update
+// locks around its read-modify-write of e.last so two snapshots never race
+// on the same delta, and clamps each delta at zero so an out-of-order
+// snapshot can't send prometheus.Counter.Add a negative value, which panics.
+func (e *Exporter) Update(s uploader.Stats) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.filesUploaded.Add(delta(s.FilesUploaded, &e.last.FilesUploaded))
+	e.filesFailed.Add(delta(s.FilesFailed, &e.last.FilesFailed))
+	e.dataBytesUploaded.Add(delta(s.DataBytesUploaded, &e.last.DataBytesUploaded))
+	e.treeRowsWritten.Add(delta(s.TreeRowsWritten, &e.last.TreeRowsWritten))
+	e.treeCacheHits.Add(delta(s.TreeCacheHits, &e.last.TreeCacheHits))
+	e.treeCacheMisses.Add(delta(s.TreeCacheMisses, &e.last.TreeCacheMisses))
+
+	e.queueDepth.Set(float64(s.QueueDepth))
+	e.inFlight.Set(float64(s.InFlight))
+	e.lastDataUpload.Set(s.LastDataUpload.Seconds())
+	e.lastTreeUpload.Set(s.LastTreeUpload.Seconds())
+}
+
+// delta returns cur-*prev clamped at zero and advances *prev to cur, but
+// only forward: the counters in Stats only ever increase, but an
+// out-of-order snapshot (arriving after a newer one, since Update can run
+// concurrently from multiple upload workers) could otherwise both corrupt
+// the running total -- prometheus.Counter.Add panics outright on a
+// negative value -- and, by moving *prev backwards, inflate the next
+// snapshot's delta by double-counting increments already reported.
+func delta(cur uint64, prev *uint64) float64 {
+	if cur <= *prev {
+		return 0
+	}
+	d := cur - *prev
+	*prev = cur
+	return float64(d)
+}
+
+// Handler returns an http.Handler serving the registered metrics in the
+// Prometheus exposition format, e.g. mux.Handle("/metrics", exp.Handler()).
+func (e *Exporter) Handler() http.Handler {
+	return promhttp.HandlerFor(e.reg, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,46 @@
+package promexp
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/lomik/carbon-clickhouse/uploader"
+)
+
+// TestUpdateConcurrentOutOfOrderSnapshots exercises the race Update's doc
+// comment claims to guard against: snapshots arriving concurrently, and
+// potentially out of order, from multiple upload worker goroutines. It
+// must not panic (prometheus.Counter.Add panics on a negative delta) and
+// the counters must end up at the final, highest snapshot's values.
+func TestUpdateConcurrentOutOfOrderSnapshots(t *testing.T) {
+	e := New()
+
+	const workers = 16
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(n int) {
+			defer wg.Done()
+			// Every worker reports the same growing sequence of snapshots,
+			// so Update sees many out-of-order arrivals of the same values.
+			for i := uint64(1); i <= 100; i++ {
+				e.Update(uploader.Stats{
+					FilesUploaded:     i,
+					DataBytesUploaded: i * 10,
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	e.Update(uploader.Stats{FilesUploaded: 100, DataBytesUploaded: 1000})
+
+	if got := testutil.ToFloat64(e.filesUploaded); got != 100 {
+		t.Errorf("filesUploaded = %v, want 100", got)
+	}
+	if got := testutil.ToFloat64(e.dataBytesUploaded); got != 1000 {
+		t.Errorf("dataBytesUploaded = %v, want 1000", got)
+	}
+}
@@ -0,0 +1,272 @@
+package uploader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// fileStatus is the state of a single file in the upload state machine:
+// New -> Uploading -> (Success: removed from map) | (Fail: Backoff, attempts++) -> Uploading -> ... -> Quarantined
+type fileStatus int
+
+const (
+	fileStatusNew fileStatus = iota
+	fileStatusUploading
+	fileStatusBackoff
+	fileStatusQuarantined
+)
+
+// fileState tracks upload progress for a single file.
+type fileState struct {
+	status       fileStatus
+	attempts     int
+	lastErr      string
+	nextEligible time.Time
+}
+
+// backoffDelay returns an exponential backoff with jitter, bounded by max.
+// attempt is 0-based (0 on the first failure).
+func backoffDelay(base, max time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		base = time.Second
+	}
+
+	d := base << uint(attempt)
+	if d <= 0 || d > max { // overflow or over cap
+		d = max
+	}
+
+	// jitter: sleep for a random duration in [d/2, d]
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// fail records a failed upload attempt for filename, advancing it to either
+// Backoff or Quarantined depending on u.maxAttempts.
+func (u *Uploader) fail(filename string, uploadErr error) {
+	atomic.AddInt64(&u.stats.inFlight, -1)
+	atomic.AddUint64(&u.stats.filesFailed, 1)
+
+	u.Lock()
+	st, ok := u.files[filename]
+	if !ok {
+		st = &fileState{}
+		u.files[filename] = st
+	}
+
+	st.attempts++
+	st.lastErr = uploadErr.Error()
+
+	if u.maxAttempts > 0 && st.attempts >= u.maxAttempts {
+		u.Unlock()
+
+		if u.quarantine(filename, st) {
+			return
+		}
+
+		// quarantine failed -- fall back to backoff below instead of stalling.
+		u.Lock()
+	}
+
+	st.status = fileStatusBackoff
+	st.nextEligible = time.Now().Add(backoffDelay(u.backoffBase, u.backoffMax, st.attempts-1))
+	u.Unlock()
+
+	if err := saveRetryState(filename, st); err != nil {
+		logrus.Errorf("[uploader] can't persist retry state for %s: %s", filename, err.Error())
+	}
+
+	logrus.Warnf("[uploader] %s failed (attempt %d/%d), retry after %s: %s",
+		filename, st.attempts, u.maxAttempts, st.nextEligible.Sub(time.Now()).String(), uploadErr.Error())
+}
+
+// retrySidecarPath returns the path saveRetryState/loadFileStates use to
+// persist filename's retry state, alongside the data file itself.
+func retrySidecarPath(filename string) string {
+	return filename + ".retry"
+}
+
+// saveRetryState persists st to filename's sidecar file.
+func saveRetryState(filename string, st *fileState) error {
+	content := fmt.Sprintf("attempts: %d\nnext_eligible: %s\nerror: %s\n",
+		st.attempts, st.nextEligible.Format(time.RFC3339), st.lastErr)
+	return ioutil.WriteFile(retrySidecarPath(filename), []byte(content), 0644)
+}
+
+// readRetryState parses a sidecar file written by saveRetryState.
+func readRetryState(sidecarPath string) (*fileState, error) {
+	data, err := ioutil.ReadFile(sidecarPath)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &fileState{status: fileStatusBackoff}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch parts[0] {
+		case "attempts":
+			n, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad attempts field: %s", sidecarPath, err.Error())
+			}
+			st.attempts = n
+		case "next_eligible":
+			t, err := time.Parse(time.RFC3339, parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad next_eligible field: %s", sidecarPath, err.Error())
+			}
+			st.nextEligible = t
+		case "error":
+			st.lastErr = parts[1]
+		}
+	}
+
+	return st, nil
+}
+
+// loadFileStates populates u.files from any *.retry sidecars left over
+// from a previous run. Call once before Start() begins processing files.
+func (u *Uploader) loadFileStates() error {
+	flist, err := ioutil.ReadDir(u.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for _, f := range flist {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".retry") {
+			continue
+		}
+
+		sidecarPath := path.Join(u.path, f.Name())
+		filename := strings.TrimSuffix(sidecarPath, ".retry")
+
+		if _, err := os.Stat(filename); err != nil {
+			// The data file is gone (uploaded, removed, or quarantined
+			// since this sidecar was written) -- it's stale, discard it.
+			os.Remove(sidecarPath)
+			continue
+		}
+
+		st, err := readRetryState(sidecarPath)
+		if err != nil {
+			logrus.Errorf("[uploader] %s", err.Error())
+			continue
+		}
+
+		u.files[filename] = st
+		n++
+	}
+
+	if n > 0 {
+		logrus.Infof("[uploader] loaded retry state for %d file(s)", n)
+	}
+	return nil
+}
+
+// quarantine moves filename into u.quarantineDir and writes a sibling .err
+// file describing the last error, then drops it from u.files. It only
+// marks filename as quarantined once the move has succeeded, returning
+// false otherwise so the caller can fall back to backoff.
+func (u *Uploader) quarantine(filename string, st *fileState) bool {
+	if err := os.MkdirAll(u.quarantineDir, 0755); err != nil {
+		logrus.Errorf("[uploader] can't create quarantine dir %s: %s", u.quarantineDir, err.Error())
+		return false
+	}
+
+	dst := filepath.Join(u.quarantineDir, filepath.Base(filename))
+
+	if err := os.Rename(filename, dst); err != nil {
+		logrus.Errorf("[uploader] can't quarantine %s: %s", filename, err.Error())
+		return false
+	}
+
+	errFile := dst + ".err"
+	content := fmt.Sprintf("time: %s\nattempts: %d\nerror: %s\n", time.Now().Format(time.RFC3339), st.attempts, st.lastErr)
+	if err := ioutil.WriteFile(errFile, []byte(content), 0644); err != nil {
+		logrus.Errorf("[uploader] can't write %s: %s", errFile, err.Error())
+	}
+
+	logrus.Errorf("[uploader] %s quarantined after %d attempts: %s", dst, st.attempts, st.lastErr)
+
+	os.Remove(retrySidecarPath(filename))
+
+	u.Lock()
+	st.status = fileStatusQuarantined
+	delete(u.files, filename)
+	u.Unlock()
+
+	return true
+}
+
+// eligible reports whether filename may be uploaded now: it is not already
+// uploading and, if in backoff, its nextEligible time has passed.
+func (u *Uploader) eligible(filename string) bool {
+	u.Lock()
+	defer u.Unlock()
+
+	st, ok := u.files[filename]
+	if !ok {
+		return true
+	}
+
+	switch st.status {
+	case fileStatusUploading, fileStatusQuarantined:
+		return false
+	case fileStatusBackoff:
+		return !time.Now().Before(st.nextEligible)
+	default:
+		return true
+	}
+}
+
+// markUploading marks filename as currently uploading, creating its state
+// if this is the first attempt. Returns false if it was already uploading.
+func (u *Uploader) markUploading(filename string) bool {
+	u.Lock()
+	defer u.Unlock()
+
+	st, ok := u.files[filename]
+	if !ok {
+		st = &fileState{}
+		u.files[filename] = st
+	}
+
+	if st.status == fileStatusUploading {
+		return false
+	}
+
+	st.status = fileStatusUploading
+	atomic.AddInt64(&u.stats.inFlight, 1)
+	return true
+}
+
+// succeed clears filename's state after a successful upload.
+func (u *Uploader) succeed(filename string) {
+	atomic.AddInt64(&u.stats.inFlight, -1)
+	atomic.AddUint64(&u.stats.filesUploaded, 1)
+
+	os.Remove(retrySidecarPath(filename))
+
+	u.Lock()
+	delete(u.files, filename)
+	u.Unlock()
+}
@@ -0,0 +1,173 @@
+package uploader
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetryStateRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploader-retry-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "default.123456")
+	if err := ioutil.WriteFile(filename, []byte("data"), 0644); err != nil {
+		t.Fatalf("write data file: %v", err)
+	}
+
+	st := &fileState{
+		attempts:     3,
+		nextEligible: time.Now().Add(time.Minute).Truncate(time.Second),
+		lastErr:      "clickhouse response status 500: boom",
+	}
+
+	if err := saveRetryState(filename, st); err != nil {
+		t.Fatalf("saveRetryState: %v", err)
+	}
+
+	got, err := readRetryState(retrySidecarPath(filename))
+	if err != nil {
+		t.Fatalf("readRetryState: %v", err)
+	}
+
+	if got.attempts != st.attempts {
+		t.Errorf("attempts = %d, want %d", got.attempts, st.attempts)
+	}
+	if !got.nextEligible.Equal(st.nextEligible) {
+		t.Errorf("nextEligible = %s, want %s", got.nextEligible, st.nextEligible)
+	}
+	if got.lastErr != st.lastErr {
+		t.Errorf("lastErr = %q, want %q", got.lastErr, st.lastErr)
+	}
+}
+
+func TestLoadFileStatesDiscardsStaleSidecars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploader-retry-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	u := New(Path(dir))
+
+	live := filepath.Join(dir, "default.live")
+	if err := ioutil.WriteFile(live, []byte("data"), 0644); err != nil {
+		t.Fatalf("write live data file: %v", err)
+	}
+	st := &fileState{attempts: 1, nextEligible: time.Now().Add(time.Minute)}
+	if err := saveRetryState(live, st); err != nil {
+		t.Fatalf("saveRetryState(live): %v", err)
+	}
+
+	gone := filepath.Join(dir, "default.gone")
+	if err := saveRetryState(gone, st); err != nil {
+		t.Fatalf("saveRetryState(gone): %v", err)
+	}
+
+	if err := u.loadFileStates(); err != nil {
+		t.Fatalf("loadFileStates: %v", err)
+	}
+
+	if _, ok := u.files[live]; !ok {
+		t.Errorf("loadFileStates did not restore state for %s", live)
+	}
+	if _, ok := u.files[gone]; ok {
+		t.Errorf("loadFileStates restored state for %s, whose data file no longer exists", gone)
+	}
+	if _, err := os.Stat(retrySidecarPath(gone)); !os.IsNotExist(err) {
+		t.Errorf("stale sidecar %s was not removed", retrySidecarPath(gone))
+	}
+}
+
+func TestQuarantineMovesFileAndWritesErrFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploader-retry-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "default.123456")
+	if err := ioutil.WriteFile(filename, []byte("data"), 0644); err != nil {
+		t.Fatalf("write data file: %v", err)
+	}
+	if err := saveRetryState(filename, &fileState{attempts: 9}); err != nil {
+		t.Fatalf("saveRetryState: %v", err)
+	}
+
+	u := New(Path(dir), QuarantineDir(filepath.Join(dir, "quarantine")))
+	st := &fileState{attempts: 10, lastErr: "boom"}
+	u.files[filename] = st
+
+	if ok := u.quarantine(filename, st); !ok {
+		t.Fatalf("quarantine returned false, want true")
+	}
+
+	if st.status != fileStatusQuarantined {
+		t.Errorf("status = %v, want fileStatusQuarantined", st.status)
+	}
+	if _, ok := u.files[filename]; ok {
+		t.Errorf("quarantine did not drop %s from u.files", filename)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("%s was not removed from its original location", filename)
+	}
+	if _, err := os.Stat(retrySidecarPath(filename)); !os.IsNotExist(err) {
+		t.Errorf("retry sidecar for %s was not removed", filename)
+	}
+
+	dst := filepath.Join(u.quarantineDir, "default.123456")
+	if _, err := os.Stat(dst); err != nil {
+		t.Errorf("quarantined file not found at %s: %v", dst, err)
+	}
+	if _, err := os.Stat(dst + ".err"); err != nil {
+		t.Errorf(".err sidecar not found at %s: %v", dst+".err", err)
+	}
+}
+
+func TestFailFallsBackToBackoffWhenQuarantineMoveFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploader-retry-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "default.123456")
+	if err := ioutil.WriteFile(filename, []byte("data"), 0644); err != nil {
+		t.Fatalf("write data file: %v", err)
+	}
+
+	// QuarantineDir points at a path that can never be created (its parent
+	// is a regular file), so quarantine() always fails before it can move
+	// the file.
+	blocker := filepath.Join(dir, "blocker")
+	if err := ioutil.WriteFile(blocker, []byte("x"), 0644); err != nil {
+		t.Fatalf("write blocker: %v", err)
+	}
+
+	u := New(Path(dir), MaxAttempts(1), QuarantineDir(filepath.Join(blocker, "quarantine")))
+
+	u.fail(filename, errors.New("upload failed"))
+
+	st, ok := u.files[filename]
+	if !ok {
+		t.Fatalf("fail() dropped %s from u.files entirely, want it retained for retry", filename)
+	}
+	if st.status != fileStatusBackoff {
+		t.Errorf("status = %v, want fileStatusBackoff", st.status)
+	}
+	if st.nextEligible.IsZero() {
+		t.Errorf("nextEligible was not set")
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("%s should remain in place after a failed quarantine attempt: %v", filename, err)
+	}
+	if _, err := os.Stat(retrySidecarPath(filename)); err != nil {
+		t.Errorf("retry sidecar for %s was not written: %v", filename, err)
+	}
+}
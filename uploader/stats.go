@@ -0,0 +1,69 @@
+package uploader
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a point-in-time snapshot of Uploader activity. It is returned
+// by Uploader.Stats() and, if StatsCallback is set, pushed to it after
+// every upload attempt.
+type Stats struct {
+	FilesUploaded     uint64        // files successfully uploaded
+	FilesFailed       uint64        // failed upload attempts, including retries
+	DataBytesUploaded uint64        // bytes POSTed to the data table
+	TreeRowsWritten   uint64        // rows POSTed to the tree table
+	TreeCacheHits     uint64        // metrics/paths already known, skipped
+	TreeCacheMisses   uint64        // metrics/paths newly inserted into the tree table
+	QueueDepth        int64         // files currently waiting in the upload queue
+	InFlight          int64         // uploads currently in progress
+	LastDataUpload    time.Duration // duration of the most recent data table upload
+	LastTreeUpload    time.Duration // duration of the most recent tree table upload
+}
+
+// stats holds the live counters backing Stats(). They are updated with
+// sync/atomic rather than u.Mutex so the hot path (upload, uploadData, the
+// tree-building loop) never contends with watch()/uploadWorker() bookkeeping.
+type stats struct {
+	filesUploaded     uint64
+	filesFailed       uint64
+	dataBytesUploaded uint64
+	treeRowsWritten   uint64
+	treeCacheHits     uint64
+	treeCacheMisses   uint64
+	inFlight          int64
+	lastDataUpload    int64 // nanoseconds
+	lastTreeUpload    int64 // nanoseconds
+}
+
+// StatsCallback registers cb to be called with a fresh Stats snapshot after
+// every upload attempt (success or failure).
+func StatsCallback(cb func(Stats)) Option {
+	return func(u *Uploader) {
+		u.statsCallback = cb
+	}
+}
+
+// Stats returns a snapshot of current upload activity.
+func (u *Uploader) Stats() Stats {
+	return Stats{
+		FilesUploaded:     atomic.LoadUint64(&u.stats.filesUploaded),
+		FilesFailed:       atomic.LoadUint64(&u.stats.filesFailed),
+		DataBytesUploaded: atomic.LoadUint64(&u.stats.dataBytesUploaded),
+		TreeRowsWritten:   atomic.LoadUint64(&u.stats.treeRowsWritten),
+		TreeCacheHits:     atomic.LoadUint64(&u.stats.treeCacheHits),
+		TreeCacheMisses:   atomic.LoadUint64(&u.stats.treeCacheMisses),
+		QueueDepth:        int64(len(u.queue)),
+		InFlight:          atomic.LoadInt64(&u.stats.inFlight),
+		LastDataUpload:    time.Duration(atomic.LoadInt64(&u.stats.lastDataUpload)),
+		LastTreeUpload:    time.Duration(atomic.LoadInt64(&u.stats.lastTreeUpload)),
+	}
+}
+
+// reportStats invokes the configured StatsCallback, if any, with the
+// current snapshot.
+func (u *Uploader) reportStats() {
+	if u.statsCallback != nil {
+		u.statsCallback(u.Stats())
+	}
+}
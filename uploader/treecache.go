@@ -0,0 +1,448 @@
+package uploader
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Tree-cache persistence modes, see TreeCacheMode.
+const (
+	TreeCacheModeExact = "exact"
+	TreeCacheModeBloom = "bloom"
+)
+
+// Tree cache file format: a single marker byte identifying the layout that
+// follows, so loadTreeCache doesn't need to guess and a mode change is
+// detected rather than misparsed.
+const (
+	treeCacheFormatExact byte = 'E'
+	treeCacheFormatBloom byte = 'B'
+)
+
+// treeKeySet is the interface exact- and bloom-mode tree-existence stores
+// both implement: Exists/Add for the hot path in buildTree, and Keys for
+// snapshotTreeCache to persist TreeCacheModeExact. bloomKeySet implements
+// Keys() as a no-op, since a bloom filter can't enumerate its contents; see
+// snapshotTreeCache.
+type treeKeySet interface {
+	Exists(key string) bool
+	Add(key string)
+	Keys() []string
+}
+
+// cmapKeySet wraps CMap with a separate key registry used only for Keys(),
+// since CMap doesn't expose a way to enumerate its keys back out.
+type cmapKeySet struct {
+	cm CMap
+
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+func newCmapKeySet() *cmapKeySet {
+	return &cmapKeySet{cm: NewCMap(), keys: make(map[string]struct{})}
+}
+
+func (c *cmapKeySet) Exists(key string) bool {
+	return c.cm.Exists(key)
+}
+
+func (c *cmapKeySet) Add(key string) {
+	c.cm.Add(key)
+
+	c.mu.Lock()
+	c.keys[key] = struct{}{}
+	c.mu.Unlock()
+}
+
+func (c *cmapKeySet) Keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.keys))
+	for k := range c.keys {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// TreeCachePath sets where the tree-existence cache is snapshotted and
+// loaded from on Start(). Defaults to a "tree-cache.bin" file under Path.
+func TreeCachePath(p string) Option {
+	return func(u *Uploader) {
+		u.treeCachePath = p
+	}
+}
+
+// TreeCacheSyncInterval sets how often the tree-existence cache is
+// snapshotted to TreeCachePath.
+func TreeCacheSyncInterval(d time.Duration) Option {
+	return func(u *Uploader) {
+		u.treeCacheSyncInterval = d
+	}
+}
+
+// TreeCacheMode selects the in-memory representation of the tree-existence
+// cache: "exact" (default) keeps every key, "bloom" keeps a fixed-size
+// bloom filter so memory stays bounded regardless of metric count.
+func TreeCacheMode(mode string) Option {
+	return func(u *Uploader) {
+		u.treeCacheMode = mode
+	}
+}
+
+// TreeCacheFalsePositiveRate sets the target false-positive rate of the
+// bloom filter used when TreeCacheMode is "bloom". Ignored otherwise.
+func TreeCacheFalsePositiveRate(r float64) Option {
+	return func(u *Uploader) {
+		u.treeCacheFalsePositiveRate = r
+	}
+}
+
+// TreeCacheBloomCapacity sets the number of distinct keys the bloom filter
+// used by TreeCacheMode "bloom" is sized for. Ignored otherwise.
+func TreeCacheBloomCapacity(n uint64) Option {
+	return func(u *Uploader) {
+		u.treeCacheBloomCapacity = n
+	}
+}
+
+// newTreeKeySet builds the tree-existence store selected by u.treeCacheMode.
+func (u *Uploader) newTreeKeySet() treeKeySet {
+	if u.treeCacheMode == TreeCacheModeBloom {
+		return newBloomKeySet(u.treeCacheBloomCapacity, u.treeCacheFalsePositiveRate)
+	}
+
+	return newCmapKeySet()
+}
+
+// loadTreeCache populates u.treeExists from TreeCachePath, if it exists.
+// Call once before Start() begins processing files, so the first files
+// seen after a restart don't re-emit tree rows ClickHouse already has.
+func (u *Uploader) loadTreeCache() error {
+	f, err := os.Open(u.treeCachePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	format, err := reader.ReadByte()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case treeCacheFormatBloom:
+		bk, ok := u.treeExists.(*bloomKeySet)
+		if !ok {
+			logrus.Warnf("[uploader] tree cache %s is a bloom filter but TreeCacheMode is %q, ignoring", u.treeCachePath, u.treeCacheMode)
+			return nil
+		}
+		if err := bk.readFrom(reader); err != nil {
+			return err
+		}
+		logrus.Infof("[uploader] loaded bloom filter tree cache from %s", u.treeCachePath)
+		return nil
+	case treeCacheFormatExact:
+		n, err := readTreeCacheKeys(reader, u.treeExists.Add)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("[uploader] loaded %d keys from tree cache %s", n, u.treeCachePath)
+		return nil
+	default:
+		return fmt.Errorf("tree cache %s: unrecognized format byte %#x", u.treeCachePath, format)
+	}
+}
+
+// readTreeCacheKeys reads the length-prefixed key records written by
+// snapshotTreeCache and calls add for each one.
+func readTreeCacheKeys(r io.Reader, add func(string)) (int, error) {
+	reader := bufio.NewReader(r)
+	var lenBuf [4]byte
+	n := 0
+
+	for {
+		if _, err := io.ReadFull(reader, lenBuf[:]); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+
+		keyLen := binary.BigEndian.Uint32(lenBuf[:])
+		key := make([]byte, keyLen)
+		if _, err := io.ReadFull(reader, key); err != nil {
+			return n, err
+		}
+
+		add(string(key))
+		n++
+	}
+}
+
+// snapshotTreeCache writes the current tree-existence set to TreeCachePath,
+// via a temp file renamed into place so a crash mid-write never leaves a
+// truncated cache behind. TreeCacheModeBloom is written as its raw bit
+// array; every other mode is written as the length-prefixed key records
+// readTreeCacheKeys expects.
+func (u *Uploader) snapshotTreeCache() error {
+	if err := os.MkdirAll(path.Dir(u.treeCachePath), 0755); err != nil {
+		return err
+	}
+
+	tmp := u.treeCachePath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	var writeErr error
+	var logMsg string
+
+	if bk, ok := u.treeExists.(*bloomKeySet); ok {
+		if writeErr = w.WriteByte(treeCacheFormatBloom); writeErr == nil {
+			writeErr = bk.writeTo(w)
+		}
+		logMsg = "bloom filter"
+	} else {
+		keys := u.treeExists.Keys()
+		writeErr = w.WriteByte(treeCacheFormatExact)
+		var lenBuf [4]byte
+		for _, key := range keys {
+			if writeErr != nil {
+				break
+			}
+			binary.BigEndian.PutUint32(lenBuf[:], uint32(len(key)))
+			if _, writeErr = w.Write(lenBuf[:]); writeErr == nil {
+				_, writeErr = w.WriteString(key)
+			}
+		}
+		logMsg = fmt.Sprintf("%d keys", len(keys))
+	}
+
+	if writeErr == nil {
+		writeErr = w.Flush()
+	}
+	if writeErr != nil {
+		f.Close()
+		os.Remove(tmp)
+		return writeErr
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, u.treeCachePath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	logrus.Infof("[uploader] snapshotted tree cache (%s) to %s", logMsg, u.treeCachePath)
+	return nil
+}
+
+// treeCacheSyncWorker periodically snapshots the tree-existence cache so
+// a restart doesn't have to relearn it from scratch.
+func (u *Uploader) treeCacheSyncWorker() {
+	defer u.wg.Done()
+
+	t := time.NewTicker(u.treeCacheSyncInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-u.ctx.Done():
+			return
+		case <-t.C:
+			if err := u.snapshotTreeCache(); err != nil {
+				logrus.Errorf("[uploader] tree cache snapshot failed: %s", err.Error())
+			}
+		}
+	}
+}
+
+// bloomKeySet is a fixed-size bloom filter implementing treeKeySet for
+// TreeCacheMode "bloom". Keys() always returns nil; snapshotTreeCache
+// persists it via writeTo instead, storing the raw bit array.
+type bloomKeySet struct {
+	sync.Mutex
+	bits []uint64
+	m    uint64 // number of bits
+	k    uint   // number of hash functions
+}
+
+func newBloomKeySet(capacity uint64, falsePositiveRate float64) *bloomKeySet {
+	if capacity == 0 {
+		capacity = 1
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = 0.01
+	}
+
+	m := uint64(math.Ceil(-1 * float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+
+	return &bloomKeySet{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+func (b *bloomKeySet) hash(key string) (uint64, uint64) {
+	h1 := fnv.New64a()
+	h1.Write([]byte{0})
+	h1.Write([]byte(key))
+
+	h2 := fnv.New64a()
+	h2.Write([]byte{1})
+	h2.Write([]byte(key))
+
+	return h1.Sum64(), h2.Sum64()
+}
+
+func (b *bloomKeySet) Add(key string) {
+	h1, h2 := b.hash(key)
+
+	b.Lock()
+	defer b.Unlock()
+	for i := uint(0); i < b.k; i++ {
+		idx := (h1 + uint64(i)*h2) % b.m
+		b.bits[idx/64] |= 1 << (idx % 64)
+	}
+}
+
+func (b *bloomKeySet) Exists(key string) bool {
+	h1, h2 := b.hash(key)
+
+	b.Lock()
+	defer b.Unlock()
+	for i := uint(0); i < b.k; i++ {
+		idx := (h1 + uint64(i)*h2) % b.m
+		if b.bits[idx/64]&(1<<(idx%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomKeySet) Keys() []string {
+	return nil
+}
+
+// writeTo serializes the filter's parameters and bit array, in that order,
+// so readFrom can reconstruct an identically-sized filter before reading
+// the bits back in.
+func (b *bloomKeySet) writeTo(w io.Writer) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if err := binary.Write(w, binary.BigEndian, b.m); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(b.k)); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, b.bits)
+}
+
+// readFrom replaces the filter's parameters and bit array with those
+// written by writeTo.
+func (b *bloomKeySet) readFrom(r io.Reader) error {
+	var m uint64
+	var k uint32
+	if err := binary.Read(r, binary.BigEndian, &m); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, &k); err != nil {
+		return err
+	}
+
+	bits := make([]uint64, (m+63)/64)
+	if err := binary.Read(r, binary.BigEndian, bits); err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.m, b.k, b.bits = m, uint(k), bits
+	return nil
+}
+
+// RebuildTreeCache seeds a tree cache file from an existing ClickHouse
+// deployment by querying treeTable for its distinct paths. Wired up as the
+// cmd/tree-cache-rebuild binary.
+func RebuildTreeCache(chURL string, treeTable string, outPath string, mode string, timeout time.Duration) error {
+	p, err := url.Parse(chURL)
+	if err != nil {
+		return err
+	}
+
+	q := p.Query()
+	q.Set("query", fmt.Sprintf("SELECT DISTINCT Path FROM %s FORMAT TabSeparated", treeTable))
+	p.RawQuery = q.Encode()
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(p.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("clickhouse response status %d: %s", resp.StatusCode, string(body))
+	}
+
+	u := &Uploader{treeCacheMode: mode, treeCacheBloomCapacity: 10000000, treeCacheFalsePositiveRate: 0.01}
+	keySet := u.newTreeKeySet()
+
+	scanner := bufio.NewScanner(resp.Body)
+	n := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		keySet.Add(line)
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	u.treeCachePath = outPath
+	u.treeExists = keySet
+	if err := u.snapshotTreeCache(); err != nil {
+		return err
+	}
+
+	logrus.Infof("[uploader] rebuilt tree cache with %d paths from %s into %s", n, treeTable, outPath)
+	return nil
+}
@@ -0,0 +1,101 @@
+package uploader
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBloomKeySetRoundTrip(t *testing.T) {
+	b := newBloomKeySet(1000, 0.01)
+
+	keys := []string{"a.b.c.", "a.b.", "a.", "x.y.z."}
+	for _, k := range keys {
+		b.Add(k)
+	}
+
+	var buf bytes.Buffer
+	if err := b.writeTo(&buf); err != nil {
+		t.Fatalf("writeTo: %v", err)
+	}
+
+	restored := &bloomKeySet{}
+	if err := restored.readFrom(&buf); err != nil {
+		t.Fatalf("readFrom: %v", err)
+	}
+
+	for _, k := range keys {
+		if !restored.Exists(k) {
+			t.Errorf("restored filter missing key %q written before round-trip", k)
+		}
+	}
+
+	if restored.Exists("never.added.") {
+		// Not a hard failure (bloom filters have false positives), but with
+		// this capacity/rate and this few keys it should not occur in
+		// practice -- flag it so a real regression doesn't hide as a flake.
+		t.Errorf("restored filter reports a false positive for a key never added")
+	}
+}
+
+func TestCmapKeySetKeys(t *testing.T) {
+	c := newCmapKeySet()
+
+	c.Add("a.b.")
+	c.Add("a.b.c.")
+	c.Add("a.b.") // duplicate add must not appear twice in Keys()
+
+	keys := c.Keys()
+	if len(keys) != 2 {
+		t.Fatalf("Keys() = %v, want 2 distinct keys", keys)
+	}
+
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		seen[k] = true
+	}
+	if !seen["a.b."] || !seen["a.b.c."] {
+		t.Fatalf("Keys() = %v, want both added keys", keys)
+	}
+
+	if !c.Exists("a.b.") {
+		t.Errorf("Exists(%q) = false, want true", "a.b.")
+	}
+	if c.Exists("never.added.") {
+		t.Errorf("Exists of a never-added key = true, want false")
+	}
+}
+
+func TestRebuildTreeCacheSeedsCacheFromClickHouse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("a.\na.b.\na.b.c.\n"))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "uploader-treecache-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "tree-cache.bin")
+	if err := RebuildTreeCache(srv.URL, "graphite_tree", out, TreeCacheModeExact, time.Second); err != nil {
+		t.Fatalf("RebuildTreeCache: %v", err)
+	}
+
+	u := New(Path(dir), TreeCachePath(out))
+	if err := u.loadTreeCache(); err != nil {
+		t.Fatalf("loadTreeCache: %v", err)
+	}
+
+	for _, key := range []string{"a.", "a.b.", "a.b.c."} {
+		if !u.treeExists.Exists(key) {
+			t.Errorf("rebuilt cache missing key %q", key)
+		}
+	}
+}
@@ -1,14 +1,8 @@
 package uploader
 
 import (
-	"bufio"
-	"bytes"
-	"fmt"
-	"io"
+	"context"
 	"io/ioutil"
-	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"path"
 	"sort"
@@ -17,7 +11,6 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/lomik/go-carbon/helper"
 )
 
 type Option func(u *Uploader)
@@ -70,27 +63,90 @@ func Threads(t int) Option {
 	}
 }
 
+// MaxAttempts sets how many times a file may fail upload before it is
+// moved to QuarantineDir. Zero disables quarantine.
+func MaxAttempts(n int) Option {
+	return func(u *Uploader) {
+		u.maxAttempts = n
+	}
+}
+
+// BackoffBase sets the initial retry delay for a failed file.
+func BackoffBase(d time.Duration) Option {
+	return func(u *Uploader) {
+		u.backoffBase = d
+	}
+}
+
+// BackoffMax caps the retry delay for a failed file.
+func BackoffMax(d time.Duration) Option {
+	return func(u *Uploader) {
+		u.backoffMax = d
+	}
+}
+
+// QuarantineDir sets the directory files are moved to once they exceed
+// MaxAttempts. Defaults to a "quarantine" subdirectory of Path.
+func QuarantineDir(dir string) Option {
+	return func(u *Uploader) {
+		u.quarantineDir = dir
+	}
+}
+
+// ShutdownTimeout bounds how long Stop() waits for in-flight uploads to
+// finish after cancelling their context.
+func ShutdownTimeout(d time.Duration) Option {
+	return func(u *Uploader) {
+		u.shutdownTimeout = d
+	}
+}
+
 // Uploader upload files from local directory to clickhouse
 type Uploader struct {
-	helper.Stoppable
 	sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
 	path               string
 	clickHouseDSN      string
 	dataTable          string
 	dataTimeout        time.Duration
 	treeTable          string
 	treeTimeout        time.Duration
-	filesUploaded      uint64 // stat "files"
 	threads            int
 	inProgressCallback func(string) bool
 	queue              chan string
-	inQueue            map[string]bool // current uploading files
-	treeExists         CMap            // store known keys and don't load it to clickhouse tree
+	files              map[string]*fileState // per-file upload state: attempts, backoff, quarantine
+	treeExists         treeKeySet            // store known keys and don't load it to clickhouse tree
+
+	maxAttempts     int
+	backoffBase     time.Duration
+	backoffMax      time.Duration
+	quarantineDir   string
+	shutdownTimeout time.Duration
+
+	dataFormat  string
+	compression string
+	pacer       *pacer
+
+	treeCachePath              string
+	treeCacheSyncInterval      time.Duration
+	treeCacheMode              string
+	treeCacheFalsePositiveRate float64
+	treeCacheBloomCapacity     uint64
+
+	stats         stats
+	statsCallback func(Stats)
 }
 
 func New(options ...Option) *Uploader {
+	ctx, cancel := context.WithCancel(context.Background())
 
 	u := &Uploader{
+		ctx:    ctx,
+		cancel: cancel,
+
 		path:               "/data/carbon-clickhouse/",
 		dataTable:          "graphite",
 		treeTable:          "graphite_tree",
@@ -98,65 +154,111 @@ func New(options ...Option) *Uploader {
 		treeTimeout:        time.Minute,
 		inProgressCallback: func(string) bool { return false },
 		queue:              make(chan string, 1024),
-		inQueue:            make(map[string]bool),
+		files:              make(map[string]*fileState),
 		threads:            1,
-		treeExists:         NewCMap(),
+
+		maxAttempts:     10,
+		backoffBase:     5 * time.Second,
+		backoffMax:      5 * time.Minute,
+		shutdownTimeout: 30 * time.Second,
+
+		dataFormat: DataFormatTabSeparated,
+
+		treeCacheSyncInterval:      5 * time.Minute,
+		treeCacheMode:              TreeCacheModeExact,
+		treeCacheFalsePositiveRate: 0.01,
+		treeCacheBloomCapacity:     10000000,
 	}
 
 	for _, o := range options {
 		o(u)
 	}
 
+	if u.quarantineDir == "" {
+		u.quarantineDir = path.Join(u.path, "quarantine")
+	}
+
+	if u.treeCachePath == "" {
+		u.treeCachePath = path.Join(u.path, "tree-cache.bin")
+	}
+
+	u.treeExists = u.newTreeKeySet()
+
 	return u
 }
 
 func (u *Uploader) Start() error {
-	return u.StartFunc(func() error {
-		u.Go(u.watchWorker)
+	if err := u.loadTreeCache(); err != nil {
+		logrus.Errorf("[uploader] tree cache load failed: %s", err.Error())
+	}
 
-		for i := 0; i < u.threads; i++ {
-			u.Go(u.uploadWorker)
-		}
+	if err := u.loadFileStates(); err != nil {
+		logrus.Errorf("[uploader] retry state load failed: %s", err.Error())
+	}
 
-		return nil
-	})
-}
+	u.wg.Add(1)
+	go u.watchWorker()
 
-func uploadData(chUrl string, table string, timeout time.Duration, data io.Reader) error {
-	p, err := url.Parse(chUrl)
-	if err != nil {
-		return err
+	for i := 0; i < u.threads; i++ {
+		u.wg.Add(1)
+		go u.uploadWorker()
 	}
 
-	q := p.Query()
+	u.wg.Add(1)
+	go u.treeCacheSyncWorker()
 
-	q.Set("query", fmt.Sprintf("INSERT INTO %s FORMAT TabSeparated", table))
+	return nil
+}
 
-	p.RawQuery = q.Encode()
-	queryUrl := p.String()
+// Stop cancels the context passed to in-flight uploads, so a ClickHouse
+// POST blocked on dataTimeout/treeTimeout aborts immediately instead of
+// delaying shutdown by up to that timeout per worker. It waits up to
+// ShutdownTimeout for workers to exit before giving up on them.
+func (u *Uploader) Stop() {
+	u.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		u.wg.Wait()
+		close(done)
+	}()
 
-	req, err := http.NewRequest("POST", queryUrl, data)
-	if err != nil {
-		return err
+	select {
+	case <-done:
+	case <-time.After(u.shutdownTimeout):
+		logrus.Warnf("[uploader] shutdown timeout (%s) exceeded, some uploads may still be in flight", u.shutdownTimeout.String())
 	}
 
-	client := &http.Client{Timeout: timeout}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+	if err := u.snapshotTreeCache(); err != nil {
+		logrus.Errorf("[uploader] tree cache snapshot failed: %s", err.Error())
 	}
-	defer resp.Body.Close()
+}
 
-	body, _ := ioutil.ReadAll(resp.Body)
+// Drain blocks until the upload queue and all tracked file state are
+// empty, or ctx is done -- useful for clean restarts and integration
+// tests that want to wait for a batch of files to finish uploading.
+func (u *Uploader) Drain(ctx context.Context) error {
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("clickhouse response status %d: %s", resp.StatusCode, string(body))
-	}
+	for {
+		u.Lock()
+		empty := len(u.queue) == 0 && len(u.files) == 0
+		u.Unlock()
 
-	return nil
+		if empty {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
 }
 
-func (u *Uploader) upload(exit chan bool, filename string) (err error) {
+func (u *Uploader) upload(ctx context.Context, filename string) (err error) {
 	startTime := time.Now()
 	logrus.Infof("[uploader] start handle %s", filename)
 
@@ -184,123 +286,36 @@ func (u *Uploader) upload(exit chan bool, filename string) (err error) {
 		return nil
 	}
 
-	err = uploadData(u.clickHouseDSN, u.dataTable, u.dataTimeout, file)
-
-	if err != nil {
-		return err
-	}
-
-	if u.treeTable == "" { // don't make index in clickhouse
-		return nil
-	}
-
-	// MAKE INDEX
-
-	// reopen file
-	file, err = os.Open(filename)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	if err != nil {
-		return err
-	}
-
-	reader := bufio.NewReaderSize(file, 1024*1024)
-
-	treeData := bytes.NewBuffer(nil)
-
-	localUniq := make(map[string]bool)
-
-	var key string
-	var level int
-	var exists bool
-	var date string
-
-LineLoop:
-	for {
-		line, _, err := reader.ReadLine()
-		if err == io.EOF {
-			break
-		}
-
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		row := strings.Split(string(line), "\t")
-		metric := row[0]
-
-		if u.treeExists.Exists(metric) {
-			continue LineLoop
-		}
-
-		if _, exists = localUniq[metric]; exists {
-			continue LineLoop
-		}
-
-		date = row[3][:8] + "01" // first day of month
-
-		offset := 0
-		for level = 1; ; level++ {
-			p := strings.IndexByte(metric[offset:], '.')
-			if p < 0 {
-				break
-			}
-			key = metric[:offset+p+1]
-
-			if !u.treeExists.Exists(key) {
-				if _, exists := localUniq[key]; !exists {
-					localUniq[key] = true
-					fmt.Fprintf(treeData, "%s\t%d\t%s\n", date, level, key)
-				}
-			}
-
-			offset += p + 1
-		}
-
-		localUniq[metric] = true
-		fmt.Fprintf(treeData, "%s\t%d\t%s\n", date, level, metric)
-	}
-
-	// @TODO: insert to tree data metrics
-	err = uploadData(u.clickHouseDSN, u.treeTable, u.treeTimeout, treeData)
-	if err != nil {
-		return err
-	}
-
-	// copy data from localUniq to global
-	for key, _ = range localUniq {
-		u.treeExists.Add(key)
-	}
-
-	return nil
+	return u.uploadFile(ctx, filename, file)
 }
 
-func (u *Uploader) uploadWorker(exit chan bool) {
+func (u *Uploader) uploadWorker() {
+	defer u.wg.Done()
+
 	for {
 		select {
-		case <-exit:
+		case <-u.ctx.Done():
 			return
 		case filename := <-u.queue:
-			err := u.upload(exit, filename)
-			if err == nil {
-				err := os.Remove(filename)
-				if err != nil {
-					logrus.Errorf("[uploader] remove %s failed: %s", filename, err.Error())
-				} else {
-					logrus.Infof("[uploader] %s deleted", filename)
-				}
+			err := u.upload(u.ctx, filename)
+			if err != nil {
+				u.fail(filename, err)
+				u.reportStats()
+				continue
 			}
-			u.Lock()
-			delete(u.inQueue, filename)
-			u.Unlock()
+
+			if err := os.Remove(filename); err != nil {
+				logrus.Errorf("[uploader] remove %s failed: %s", filename, err.Error())
+			} else {
+				logrus.Infof("[uploader] %s deleted", filename)
+			}
+			u.succeed(filename)
+			u.reportStats()
 		}
 	}
 }
 
-func (u *Uploader) watch(exit chan bool) {
+func (u *Uploader) watch() {
 	flist, err := ioutil.ReadDir(u.path)
 	if err != nil {
 		logrus.Errorf("[uploader] %s", err.Error())
@@ -315,6 +330,9 @@ func (u *Uploader) watch(exit chan bool) {
 		if !strings.HasPrefix(f.Name(), "default.") {
 			continue
 		}
+		if strings.HasSuffix(f.Name(), ".retry") {
+			continue // retry.go's persisted fileState sidecar, not a data file
+		}
 
 		files = append(files, path.Join(u.path, f.Name()))
 	}
@@ -330,34 +348,35 @@ func (u *Uploader) watch(exit chan bool) {
 			continue
 		}
 
-		u.Lock()
-		if u.inQueue[fn] {
-			u.Unlock()
+		if !u.eligible(fn) { // uploading, in backoff, or quarantined
+			continue
+		}
+
+		if !u.markUploading(fn) {
 			continue
-		} else {
-			u.inQueue[fn] = true
 		}
-		u.Unlock()
 
 		select {
 		case u.queue <- fn:
 			// pass
-		case <-exit:
+		case <-u.ctx.Done():
 			return
 		}
 	}
 }
 
-func (u *Uploader) watchWorker(exit chan bool) {
+func (u *Uploader) watchWorker() {
+	defer u.wg.Done()
+
 	t := time.NewTicker(time.Second)
 	defer t.Stop()
 
 	for {
 		select {
-		case <-exit:
+		case <-u.ctx.Done():
 			return
 		case <-t.C:
-			u.watch(exit)
+			u.watch()
 		}
 	}
 }
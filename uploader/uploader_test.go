@@ -0,0 +1,125 @@
+package uploader
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestStopCancelsInFlightUpload checks that Stop() aborts an in-flight
+// upload via context cancellation instead of waiting for it: the data
+// table endpoint here never answers until the test ends, so if Stop()
+// didn't cancel the request context, it would have to wait out the full
+// ShutdownTimeout.
+func TestStopCancelsInFlightUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploader-stop-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// unblock is closed only once the test is done asserting, not on
+	// request-context cancellation -- the assertion under test is that
+	// Stop() itself returns promptly, not how fast the server notices.
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer func() {
+		close(unblock)
+		server.Close()
+	}()
+
+	u := New(
+		Path(dir),
+		ClickHouse(server.URL),
+		DataTable("graphite"),
+		DataTimeout(time.Minute),
+		TreeTable(""),
+		ShutdownTimeout(5*time.Second),
+		Threads(1),
+	)
+
+	filename := filepath.Join(dir, "default.123456")
+	if err := ioutil.WriteFile(filename, []byte("a.b.c\t1\t2\t20230101000000\n"), 0644); err != nil {
+		t.Fatalf("write data file: %v", err)
+	}
+
+	if err := u.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for u.Stats().InFlight == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("upload never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stopStart := time.Now()
+	u.Stop()
+	elapsed := time.Since(stopStart)
+
+	if elapsed > 2*time.Second {
+		t.Fatalf("Stop() took %s, want well under ShutdownTimeout (%s) -- ctx cancellation should abort the in-flight POST immediately", elapsed, u.shutdownTimeout)
+	}
+}
+
+// TestDrainWaitsForQueueEmpty checks that Drain blocks until a file that
+// was queued on Start has actually finished uploading and been removed.
+func TestDrainWaitsForQueueEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploader-drain-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The data table answers slowly enough that, once watch()'s one-second
+	// ticker has picked the file up, the upload is still in flight when
+	// Drain is called below -- otherwise Drain could race an upload that
+	// finishes so fast it never observes a non-empty queue/files map.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		time.Sleep(time.Second)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	u := New(
+		Path(dir),
+		ClickHouse(server.URL),
+		DataTable("graphite"),
+		DataTimeout(5*time.Second),
+		TreeTable(""),
+		Threads(1),
+	)
+
+	filename := filepath.Join(dir, "default.123456")
+	if err := ioutil.WriteFile(filename, []byte("a.b.c\t1\t2\t20230101000000\n"), 0644); err != nil {
+		t.Fatalf("write data file: %v", err)
+	}
+
+	if err := u.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer u.Stop()
+
+	time.Sleep(1300 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := u.Drain(ctx); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Drain returned but %s was not uploaded and removed", filename)
+	}
+}